@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Record is one access-log entry: everything proxii knows about a single
+// request (or tunnel) by the time it finishes.
+type Record struct {
+	RequestID  uint64        `json:"request_id"`
+	ClientAddr string        `json:"client_addr"`
+	Method     string        `json:"method"`
+	Scheme     string        `json:"scheme,omitempty"`
+	Host       string        `json:"host"`
+	Path       string        `json:"path,omitempty"`
+	DialTime   time.Duration `json:"dial_time_ns,omitempty"`
+	TTFB       time.Duration `json:"ttfb_ns,omitempty"`
+	BytesIn    int64         `json:"bytes_in"`
+	BytesOut   int64         `json:"bytes_out"`
+	Status     int           `json:"status,omitempty"`
+	ErrorClass string        `json:"error_class,omitempty"`
+	Err        string        `json:"error,omitempty"`
+}
+
+// AccessLogger receives one Record per finished request. Implementations
+// must be safe for concurrent use: ServeHTTP handles requests concurrently.
+type AccessLogger interface {
+	Log(record *Record)
+}
+
+// RecordHook lets embedders observe every finished request, e.g. to ship
+// records to Prometheus or a SIEM, independently of the configured
+// AccessLogger.
+type RecordHook func(record *Record)
+
+// NewAccessLogger builds an AccessLogger writing to w in the given format
+// ("text" or "json"); an empty format defaults to "text".
+func NewAccessLogger(format string, w io.Writer) (AccessLogger, error) {
+	switch format {
+	case "", "text":
+		return &textAccessLogger{logger: log.New(w, "", log.LstdFlags)}, nil
+
+	case "json":
+		return &jsonAccessLogger{encoder: json.NewEncoder(w)}, nil
+
+	default:
+		return nil, fmt.Errorf("accesslog: unknown format %q", format)
+	}
+}
+
+type textAccessLogger struct {
+	logger *log.Logger
+}
+
+func (l *textAccessLogger) Log(r *Record) {
+	l.logger.Printf(
+		"%d | %s %s %s%s | status=%d in=%d out=%d dial=%s ttfb=%s errclass=%s err=%s",
+		r.RequestID, r.ClientAddr, r.Method, r.Host, r.Path,
+		r.Status, r.BytesIn, r.BytesOut, r.DialTime, r.TTFB, r.ErrorClass, r.Err,
+	)
+}
+
+type jsonAccessLogger struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func (l *jsonAccessLogger) Log(r *Record) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.encoder.Encode(r)
+}
+
+// classifyDialError turns a dial/request error into one of a small set of
+// stable classes ("dns", "timeout", "reset", "dial") so logs and metrics
+// don't have to parse error strings. Used by handleConnect, handleWebsocket
+// and handleRequest.
+func classifyDialError(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) {
+		return "reset"
+	}
+
+	return "dial"
+}
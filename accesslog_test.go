@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRecordJSONShape(t *testing.T) {
+	record := &Record{
+		RequestID:  42,
+		ClientAddr: "127.0.0.1:1234",
+		Method:     "GET",
+		Scheme:     "https",
+		Host:       "example.com",
+		Path:       "/foo",
+		DialTime:   5 * time.Millisecond,
+		TTFB:       10 * time.Millisecond,
+		BytesIn:    100,
+		BytesOut:   200,
+		Status:     200,
+		ErrorClass: "",
+		Err:        "",
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal("Marshal error:", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal("Unmarshal error:", err)
+	}
+
+	wantKeys := []string{
+		"request_id", "client_addr", "method", "scheme", "host", "path",
+		"dial_time_ns", "ttfb_ns", "bytes_in", "bytes_out", "status",
+	}
+	for _, key := range wantKeys {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("JSON output missing field %q: %s", key, data)
+		}
+	}
+
+	for _, key := range []string{"error_class", "error"} {
+		if _, ok := fields[key]; ok {
+			t.Errorf("JSON output has field %q, want omitted when empty: %s", key, data)
+		}
+	}
+
+	if got, want := fields["request_id"], float64(42); got != want {
+		t.Errorf("request_id = %v, want %v", got, want)
+	}
+
+	if got, want := fields["host"], "example.com"; got != want {
+		t.Errorf("host = %v, want %v", got, want)
+	}
+}
+
+func TestNewAccessLoggerFormats(t *testing.T) {
+	var buf bytes.Buffer
+
+	if _, err := NewAccessLogger("", &buf); err != nil {
+		t.Errorf("NewAccessLogger(\"\") error: %v", err)
+	}
+
+	if _, err := NewAccessLogger("text", &buf); err != nil {
+		t.Errorf("NewAccessLogger(\"text\") error: %v", err)
+	}
+
+	if _, err := NewAccessLogger("json", &buf); err != nil {
+		t.Errorf("NewAccessLogger(\"json\") error: %v", err)
+	}
+
+	if _, err := NewAccessLogger("xml", &buf); err == nil {
+		t.Error("NewAccessLogger(\"xml\") expected an error for an unknown format")
+	}
+}
+
+func TestTextAccessLoggerLog(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger, err := NewAccessLogger("text", &buf)
+	if err != nil {
+		t.Fatal("NewAccessLogger error:", err)
+	}
+
+	logger.Log(&Record{
+		RequestID: 7,
+		Method:    "GET",
+		Host:      "example.com",
+		Path:      "/foo",
+		Status:    200,
+	})
+
+	out := buf.String()
+	for _, want := range []string{"7", "GET", "example.com", "/foo", "status=200"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("text log output %q missing %q", out, want)
+		}
+	}
+}
+
+func TestJSONAccessLoggerLog(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger, err := NewAccessLogger("json", &buf)
+	if err != nil {
+		t.Fatal("NewAccessLogger error:", err)
+	}
+
+	logger.Log(&Record{RequestID: 1, Host: "example.com", Status: 200})
+	logger.Log(&Record{RequestID: 2, Host: "example.org", Status: 404})
+
+	decoder := json.NewDecoder(&buf)
+
+	var first, second Record
+	if err := decoder.Decode(&first); err != nil {
+		t.Fatal("Decode first record error:", err)
+	}
+	if err := decoder.Decode(&second); err != nil {
+		t.Fatal("Decode second record error:", err)
+	}
+
+	if first.Host != "example.com" || second.Host != "example.org" {
+		t.Errorf("Decoded hosts = %q, %q, want example.com, example.org", first.Host, second.Host)
+	}
+}
+
+func TestClassifyDialError(t *testing.T) {
+	timeoutErr := &net.OpError{Op: "dial", Err: timeoutError{}}
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil", nil, ""},
+		{"dns", &net.DNSError{Err: "no such host", Name: "example.invalid"}, "dns"},
+		{"timeout", timeoutErr, "timeout"},
+		{"reset", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, "reset"},
+		{"other", errors.New("connection refused"), "dial"},
+	}
+
+	for _, test := range tests {
+		if got := classifyDialError(test.err); got != test.want {
+			t.Errorf("classifyDialError(%v) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,22 @@
+package main
+
+import "io"
+
+// countingReader wraps an io.Reader and tracks the number of bytes read
+// through it, so handleRequest can report BytesIn without assuming
+// anything about the underlying request body.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if c.r == nil {
+		return 0, io.EOF
+	}
+
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// dialHTTPConnect dials addr through the HTTP upstream proxy described by
+// proxyURL by issuing "CONNECT host:port HTTP/1.1" and parsing the 200
+// response before handing the socket back.
+func dialHTTPConnect(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("httpconnect: dial upstream %s: %w", proxyURL.Host, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	if proxyURL.User != nil {
+		if password, ok := proxyURL.User.Password(); ok {
+			connectReq.SetBasicAuth(proxyURL.User.Username(), password)
+		}
+	}
+
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("httpconnect: CONNECT request: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(reader, connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("httpconnect: CONNECT response: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("httpconnect: upstream refused CONNECT: %s", resp.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("httpconnect: unexpected data buffered after CONNECT response")
+	}
+
+	return conn, nil
+}
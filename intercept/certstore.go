@@ -0,0 +1,336 @@
+// Package intercept implements TLS MITM interception: minting short-lived
+// leaf certificates on the fly, signed by a configurable root CA, so proxii
+// can terminate a client's TLS connection instead of blindly tunneling it.
+package intercept
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	caKeyBits   = 2048
+	leafKeyBits = 2048
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 7 * 24 * time.Hour
+
+	// leaves within this window of expiring are rotated by the background
+	// sweep started with StartRotation.
+	rotateWithin = 24 * time.Hour
+
+	// maxCachedLeaves bounds the LRU before the oldest entry is evicted.
+	maxCachedLeaves = 1024
+)
+
+// CertStore mints and caches leaf certificates signed by a root CA, keyed by
+// SNI. It implements tls.Config.GetCertificate via GetCertificate.
+type CertStore struct {
+	caCert *x509.Certificate
+	caKey  *rsa.PrivateKey
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	lru     []string // most-recently-used at the end
+
+	stop chan struct{}
+}
+
+type cacheEntry struct {
+	cert     *tls.Certificate
+	notAfter time.Time
+}
+
+// LoadOrCreateCA loads a root CA from certPath/keyPath, generating and
+// writing a new one if either file is missing.
+func LoadOrCreateCA(certPath, keyPath string) (*CertStore, error) {
+	cert, key, err := loadCA(certPath, keyPath)
+	if os.IsNotExist(err) {
+		cert, key, err = generateCA()
+		if err != nil {
+			return nil, fmt.Errorf("intercept: generate root CA: %w", err)
+		}
+
+		if err := saveCA(certPath, keyPath, cert, key); err != nil {
+			return nil, fmt.Errorf("intercept: save root CA: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("intercept: load root CA: %w", err)
+	}
+
+	return NewCertStore(cert, key), nil
+}
+
+// NewCertStore builds a CertStore around an already-loaded root CA.
+func NewCertStore(caCert *x509.Certificate, caKey *rsa.PrivateKey) *CertStore {
+	return &CertStore{
+		caCert:  caCert,
+		caKey:   caKey,
+		entries: make(map[string]*cacheEntry),
+		stop:    make(chan struct{}),
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate: it returns a leaf
+// certificate for hello.ServerName, minting and caching one if needed.
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cs.certificateFor(hello.ServerName)
+}
+
+// GetCertificateForHost is like GetCertificate but falls back to
+// fallbackHost (the original CONNECT target) when the client's ClientHello
+// carries no SNI, which Go's own TLS client omits for IP-literal addresses
+// per RFC 6066. Callers intercepting a CONNECT tunnel should use this
+// instead of GetCertificate directly so IP-literal origins still work.
+func (cs *CertStore) GetCertificateForHost(hello *tls.ClientHelloInfo, fallbackHost string) (*tls.Certificate, error) {
+	host := hello.ServerName
+	if host == "" {
+		host = fallbackHost
+	}
+
+	return cs.certificateFor(host)
+}
+
+func (cs *CertStore) certificateFor(host string) (*tls.Certificate, error) {
+	if host == "" {
+		return nil, fmt.Errorf("intercept: no SNI and no fallback host available")
+	}
+
+	if cert, ok := cs.lookup(host); ok {
+		return cert, nil
+	}
+
+	cert, notAfter, err := cs.mintLeaf(host)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.store(host, cert, notAfter)
+
+	return cert, nil
+}
+
+func (cs *CertStore) lookup(host string) (*tls.Certificate, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	entry, ok := cs.entries[host]
+	if !ok {
+		return nil, false
+	}
+
+	cs.touch(host)
+
+	return entry.cert, true
+}
+
+func (cs *CertStore) store(host string, cert *tls.Certificate, notAfter time.Time) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.entries[host] = &cacheEntry{cert: cert, notAfter: notAfter}
+	cs.touch(host)
+
+	for len(cs.lru) > maxCachedLeaves {
+		oldest := cs.lru[0]
+		cs.lru = cs.lru[1:]
+		delete(cs.entries, oldest)
+	}
+}
+
+// touch must be called with cs.mu held.
+func (cs *CertStore) touch(host string) {
+	for i, h := range cs.lru {
+		if h == host {
+			cs.lru = append(cs.lru[:i], cs.lru[i+1:]...)
+			break
+		}
+	}
+
+	cs.lru = append(cs.lru, host)
+}
+
+// StartRotation starts a background goroutine that, every interval, mints
+// fresh leaves for any cached host whose certificate is within rotateWithin
+// of expiring. Call Close to stop it.
+func (cs *CertStore) StartRotation(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				cs.rotateNearExpiry()
+			case <-cs.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (cs *CertStore) rotateNearExpiry() {
+	cs.mu.Lock()
+	due := make([]string, 0)
+	for host, entry := range cs.entries {
+		if time.Until(entry.notAfter) < rotateWithin {
+			due = append(due, host)
+		}
+	}
+	cs.mu.Unlock()
+
+	for _, host := range due {
+		if cert, notAfter, err := cs.mintLeaf(host); err == nil {
+			cs.store(host, cert, notAfter)
+		}
+	}
+}
+
+// Close stops the background rotation goroutine, if any was started.
+func (cs *CertStore) Close() {
+	select {
+	case <-cs.stop:
+	default:
+		close(cs.stop)
+	}
+}
+
+func (cs *CertStore) mintLeaf(host string) (*tls.Certificate, time.Time, error) {
+	key, err := rsa.GenerateKey(rand.Reader, leafKeyBits)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("intercept: generate leaf key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("intercept: generate serial: %w", err)
+	}
+
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := notBefore.Add(leafValidity)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, cs.caCert, &key.PublicKey, cs.caKey)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("intercept: sign leaf for %q: %w", host, err)
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, cs.caCert.Raw},
+		PrivateKey:  key,
+	}
+
+	return cert, notAfter, nil
+}
+
+func generateCA() (*x509.Certificate, *rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, caKeyBits)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "proxii MITM root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+func loadCA(certPath, keyPath string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, nil, fmt.Errorf("intercept: %s is not PEM", certPath)
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("intercept: %s is not PEM", keyPath)
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+func saveCA(certPath, keyPath string, cert *x509.Certificate, key *rsa.PrivateKey) error {
+	certOut, err := os.OpenFile(certPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer certOut.Close()
+
+	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+		return err
+	}
+
+	keyOut, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer keyOut.Close()
+
+	return pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
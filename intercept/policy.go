@@ -0,0 +1,45 @@
+package intercept
+
+import (
+	"path"
+	"strings"
+)
+
+// Policy decides, per host, whether a CONNECT tunnel should be intercepted
+// (TLS terminated and proxied through handleRequest) or left as an opaque
+// tunnel. Deny takes priority over Allow; an empty Allow list means "allow
+// everything not denied".
+type Policy struct {
+	Allow []string
+	Deny  []string
+}
+
+// ShouldIntercept reports whether host should be MITM'd under p.
+func (p *Policy) ShouldIntercept(host string) bool {
+	if p == nil {
+		return false
+	}
+
+	for _, glob := range p.Deny {
+		if matchGlob(glob, host) {
+			return false
+		}
+	}
+
+	if len(p.Allow) == 0 {
+		return true
+	}
+
+	for _, glob := range p.Allow {
+		if matchGlob(glob, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchGlob(glob, host string) bool {
+	ok, err := path.Match(strings.ToLower(glob), strings.ToLower(host))
+	return err == nil && ok
+}
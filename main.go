@@ -1,16 +1,26 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"net/http/httptrace"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/aaronps/proxii/intercept"
+	"github.com/aaronps/proxii/tunnel"
+	"github.com/gorilla/websocket"
 )
 
 const (
@@ -21,9 +31,22 @@ const (
 func main() {
 	log.Print("Proxii V.", proxiiVersion)
 
+	proxyChain := flag.String("proxy-chain", "", "comma-separated list of upstream proxies to dial through (socks5://[user:pass@]host:port or http://[user:pass@]host:port), in priority order")
+	noProxy := flag.String("no-proxy", "", "comma-separated host globs that bypass --proxy-chain and are dialed directly")
+	caCertPath := flag.String("ca-cert", "", "path to the root CA certificate used for TLS interception (generated on first run if missing)")
+	caKeyPath := flag.String("ca-key", "", "path to the root CA private key used for TLS interception (generated on first run if missing)")
+	logFormat := flag.String("log-format", "text", "access log format: text or json")
+	accessLogPath := flag.String("access-log", "", "file to write the access log to (default: stderr)")
+	maxConns := flag.Int("max-conns", 0, "maximum number of concurrent requests/tunnels proxii will serve (0 = unlimited)")
+	maxConnsPerHost := flag.Int("max-conns-per-host", 0, "maximum number of concurrent requests/tunnels proxii will serve to any single upstream host (0 = unlimited)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for in-flight requests/tunnels to drain on SIGINT/SIGTERM before forcing them closed")
+	rewriteRulesPath := flag.String("rewrite-rules", "", "path to a JSON or YAML rewrite rules file (see LoadRewriteRules)")
+	viaPseudonym := flag.String("via", "", "pseudonym to advertise in an added Via header; empty disables it")
+	flag.Parse()
+
 	listenAddr := defaultListenPort
-	if len(os.Args) > 1 {
-		listenAddr = os.Args[1]
+	if flag.NArg() > 0 {
+		listenAddr = flag.Arg(0)
 	}
 
 	ps, err := newProxii(listenAddr)
@@ -31,17 +54,101 @@ func main() {
 		log.Fatalf("Cannot create Proxii: %v", err)
 	}
 
+	accessLogWriter := os.Stderr
+	if *accessLogPath != "" {
+		accessLogWriter, err = os.OpenFile(*accessLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Fatalf("Cannot open access log %s: %v", *accessLogPath, err)
+		}
+	}
+
+	accessLogger, err := NewAccessLogger(*logFormat, accessLogWriter)
+	if err != nil {
+		log.Fatalf("Cannot set up access log: %v", err)
+	}
+
+	ps.SetAccessLogger(accessLogger)
+
+	ps.UseRequestRewriter(StripHopByHop())
+
+	if *viaPseudonym != "" {
+		ps.UseRequestRewriter(AddVia(*viaPseudonym))
+	}
+
+	if *rewriteRulesPath != "" {
+		if err := ps.UseRewriteRulesFile(*rewriteRulesPath); err != nil {
+			log.Fatalf("Cannot load rewrite rules: %v", err)
+		}
+	}
+
+	if *proxyChain != "" {
+		chain, err := NewProxyChain(splitCSV(*proxyChain), splitCSV(*noProxy))
+		if err != nil {
+			log.Fatalf("Cannot set up proxy chain: %v", err)
+		}
+
+		ps.SetProxyChain(chain)
+	}
+
+	if *caCertPath != "" && *caKeyPath != "" {
+		certStore, err := intercept.LoadOrCreateCA(*caCertPath, *caKeyPath)
+		if err != nil {
+			log.Fatalf("Cannot set up TLS interception: %v", err)
+		}
+
+		certStore.StartRotation(time.Hour)
+		ps.SetIntercept(certStore, &intercept.Policy{})
+	}
+
+	ps.SetMaxConns(*maxConns)
+	ps.SetMaxConnsPerHost(*maxConnsPerHost)
+
 	log.Printf("Listenin on port: %d", ps.listener.Addr())
 
-	ps.serve()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- ps.serve() }()
+
+	select {
+	case err := <-serveErr:
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Serve error: %v", err)
+		}
+	case sig := <-signals:
+		log.Printf("Received %v, shutting down", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+
+		if err := ps.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown error: %v", err)
+		}
+	}
 }
 
 type proxii struct {
-	requestCounter uint64
-	listener       net.Listener
-	dialer         *net.Dialer
-	server         *http.Server
-	client         *http.Client
+	requestCounter  uint64
+	listener        net.Listener
+	dialer          *net.Dialer
+	server          *http.Server
+	client          *http.Client
+	proxyChain      *ProxyChain
+	certStore       *intercept.CertStore
+	interceptPolicy *intercept.Policy
+	accessLogger    AccessLogger
+	recordHook      RecordHook
+
+	requestRewriters  []RequestRewriter
+	responseRewriters []ResponseRewriter
+
+	wsMessageHook WebSocketMessageHook
+
+	activeTunnels   sync.Map
+	connSemaphore   chan struct{}
+	maxConnsPerHost int
+	hostSemaphores  sync.Map
 }
 
 func newProxii(addr string) (*proxii, error) {
@@ -52,64 +159,130 @@ func newProxii(addr string) (*proxii, error) {
 
 	dialer := &net.Dialer{Timeout: 4000 * time.Millisecond}
 
-	client := &http.Client{
+	result := &proxii{
+		listener: listener,
+		dialer:   dialer,
+	}
+
+	result.client = &http.Client{
 		Transport: &http.Transport{
-			DialContext: dialer.DialContext,
+			DialContext: result.dialUpstream,
 		},
 		Timeout: time.Millisecond * 10000,
 	}
 
-	result := &proxii{
-		listener: listener,
-		client:   client,
-		dialer:   dialer,
+	result.server = &http.Server{Handler: result}
+
+	accessLogger, err := NewAccessLogger("text", log.Writer())
+	if err != nil {
+		return nil, err
 	}
 
-	result.server = &http.Server{Handler: result}
+	result.accessLogger = accessLogger
 
 	return result, nil
 }
 
+// SetProxyChain configures the upstream proxy chain used for every dial
+// proxii performs (CONNECT, WebSocket and plain HTTP). Passing nil restores
+// direct dialing.
+func (p *proxii) SetProxyChain(chain *ProxyChain) {
+	p.proxyChain = chain
+}
+
+// SetIntercept enables TLS MITM interception: CONNECT tunnels to hosts
+// allowed by policy are terminated with a leaf certificate minted by
+// certStore and proxied through handleRequest instead of tunneled opaquely.
+// Passing a nil certStore disables interception.
+func (p *proxii) SetIntercept(certStore *intercept.CertStore, policy *intercept.Policy) {
+	p.certStore = certStore
+	p.interceptPolicy = policy
+}
+
+// SetAccessLogger replaces the AccessLogger every finished request is
+// reported to. Passing nil disables access logging.
+func (p *proxii) SetAccessLogger(logger AccessLogger) {
+	p.accessLogger = logger
+}
+
+// SetRecordHook registers a RecordHook invoked with every finished
+// request's Record, independently of the configured AccessLogger.
+func (p *proxii) SetRecordHook(hook RecordHook) {
+	p.recordHook = hook
+}
+
 func (p *proxii) serve() error {
-	return http.Serve(p.listener, p)
+	return p.server.Serve(p.listener)
 }
 
 func (p *proxii) close() error {
 	return p.server.Close()
 }
 
+func (p *proxii) logRecord(record *Record) {
+	if p.accessLogger != nil {
+		p.accessLogger.Log(record)
+	}
+
+	if p.recordHook != nil {
+		p.recordHook(record)
+	}
+}
+
 func (p *proxii) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method == http.MethodGet && request.URL.Host == "" && request.URL.Path == debugEndpointPath {
+		p.serveDebugEndpoint(response)
+		return
+	}
+
+	if !p.acquireConnSlot(request.Host) {
+		response.Header().Set("Retry-After", "1")
+		response.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(response, "Too many connections")
+		return
+	}
+
+	defer p.releaseConnSlot(request.Host)
+
 	requestID := atomic.AddUint64(&p.requestCounter, 1)
 
-	log.Print(requestID, "| Method: ", request.Method, " URL: ", request.URL, " Proto: ", request.Proto, " Host: ", request.Host)
+	record := &Record{
+		RequestID:  requestID,
+		ClientAddr: request.RemoteAddr,
+		Method:     request.Method,
+		Host:       request.Host,
+	}
 
 	if request.Method == "CONNECT" {
-		handleConnect(requestID, p.dialer, response, request)
-	} else if strings.ToLower(request.Header.Get("Connection")) == "upgrade" && strings.ToLower(request.Header.Get("upgrade")) == "websocket" {
-		handleWebsocket(requestID, p.dialer, response, request)
+		p.handleConnect(record, response, request)
+	} else if isWebsocketUpgrade(request) {
+		p.handleWebsocket(record, response, request)
 	} else {
-		handleRequest(requestID, p.client, response, request)
+		record.Scheme = request.URL.Scheme
+		record.Path = request.URL.Path
+		p.handleRequest(record, response, request)
 	}
 
-	log.Print(requestID, "| Request end: ")
+	p.logRecord(record)
 }
 
-func handleConnect(requestID uint64, dialer *net.Dialer, response http.ResponseWriter, request *http.Request) {
+func (p *proxii) handleConnect(record *Record, response http.ResponseWriter, request *http.Request) {
 	rh := response.Header()
 
-	conn, err := dialer.Dial("tcp", request.Host)
-	if err != nil {
-		if neterror, ok := err.(*net.OpError); ok {
-			switch realerror := neterror.Err.(type) {
-			case *net.DNSError:
-				log.Print(requestID, "| Connect error(dns): ", realerror.Error())
+	host := hostOnly(request.Host)
+	if p.certStore != nil && p.interceptPolicy.ShouldIntercept(host) {
+		p.handleInterceptedConnect(record, response, request)
+		return
+	}
 
-			default:
-				log.Print(requestID, "| Connect error:(net)", realerror.Error())
-			}
-		} else {
-			log.Print(requestID, "| Connect error(gen): ", err)
-		}
+	dialStart := time.Now()
+	conn, err := p.dialUpstream(request.Context(), "tcp", request.Host)
+	record.DialTime = time.Since(dialStart)
+
+	if err != nil {
+		record.ErrorClass = classifyDialError(err)
+		record.Err = err.Error()
+		record.Status = http.StatusBadGateway
 		rh.Add("Content-Type", "text/plain")
 		response.WriteHeader(http.StatusBadGateway)
 		fmt.Fprintf(response, "Connect error: %v", err)
@@ -123,15 +296,135 @@ func handleConnect(requestID uint64, dialer *net.Dialer, response http.ResponseW
 
 	defer clientConn.Close()
 
-	log.Print(requestID, "| Connect success")
+	record.Status = http.StatusOK
+	clientRw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+	clientRw.Flush()
+
+	untrack := p.trackTunnel(record.RequestID, request.Host, clientConn)
+	defer untrack()
+
+	up, down, pumpErr := tunnel.Pump(request.Context(), clientConn, conn)
+	record.BytesIn = up
+	record.BytesOut = down
+
+	if pumpErr != nil {
+		record.Err = pumpErr.Error()
+	}
+}
+
+// handleInterceptedConnect terminates the client's TLS connection with a
+// leaf minted by p.certStore, dials the real origin, and proxies the
+// decrypted HTTP requests through handleRequest so the middleware chain and
+// logging see plaintext headers/bodies. On a hijack or TLS handshake failure
+// it records the error and returns; the connection is not fallen back to an
+// opaque tunnel.
+func (p *proxii) handleInterceptedConnect(record *Record, response http.ResponseWriter, request *http.Request) {
+	rh := response.Header()
+
+	hijacker, _ := response.(http.Hijacker)
+	clientConn, clientRw, err := hijacker.Hijack()
+	if err != nil {
+		record.ErrorClass = "gen"
+		record.Err = err.Error()
+		rh.Add("Content-Type", "text/plain")
+		response.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(response, "Intercept hijack error: %v", err)
+		return
+	}
+
+	defer clientConn.Close()
+
 	clientRw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
 	clientRw.Flush()
 
-	go io.Copy(conn, clientRw)
-	io.Copy(clientRw, conn)
+	fallbackHost := hostOnly(request.Host)
+	tlsConn := tls.Server(clientConn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.certStore.GetCertificateForHost(hello, fallbackHost)
+		},
+	})
+
+	if err := tlsConn.Handshake(); err != nil {
+		record.ErrorClass = "tls"
+		record.Err = err.Error()
+		return
+	}
+
+	defer tlsConn.Close()
+
+	record.Status = http.StatusOK
+
+	untrack := p.trackTunnel(record.RequestID, request.Host, tlsConn)
+	defer untrack()
+
+	listener := newSingleConnListener(tlsConn)
+	defer listener.Close()
+
+	// done is closed once tlsConn's one connection actually finishes being
+	// served, which can happen well after Serve (below) returns: Serve's
+	// accept loop hands the connection to its own goroutine and immediately
+	// calls Accept again, which is exactly what newSingleConnListener's
+	// single-connection contract rejects. Without waiting on done here, the
+	// cleanup defers above would close tlsConn out from under that
+	// still-running goroutine.
+	done := make(chan struct{})
+	var closeDone sync.Once
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(interceptedResponse http.ResponseWriter, interceptedRequest *http.Request) {
+			interceptedRequestID := atomic.AddUint64(&p.requestCounter, 1)
+
+			interceptedRecord := &Record{
+				RequestID:  interceptedRequestID,
+				ClientAddr: record.ClientAddr,
+				Method:     interceptedRequest.Method,
+				Host:       request.Host,
+				Path:       interceptedRequest.URL.Path,
+				Scheme:     "https",
+			}
+
+			interceptedRequest.URL.Scheme = "https"
+			interceptedRequest.URL.Host = request.Host
+
+			p.handleRequest(interceptedRecord, interceptedResponse, interceptedRequest)
+
+			p.logRecord(interceptedRecord)
+		}),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				closeDone.Do(func() { close(done) })
+			}
+		},
+	}
+
+	server.Serve(listener)
+	<-done
 }
 
-func handleRequest(requestID uint64, client *http.Client, response http.ResponseWriter, request *http.Request) {
+// splitCSV splits a comma-separated flag value, trimming whitespace around
+// each entry and dropping any that are empty. An empty s returns nil.
+func splitCSV(s string) []string {
+	var out []string
+
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			out = append(out, field)
+		}
+	}
+
+	return out
+}
+
+func hostOnly(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+
+	return host
+}
+
+func (p *proxii) handleRequest(record *Record, response http.ResponseWriter, request *http.Request) {
 	rh := response.Header()
 
 	// the next two are to support transparent proxy function
@@ -143,9 +436,13 @@ func handleRequest(requestID uint64, client *http.Client, response http.Response
 		request.URL.Host = request.Host
 	}
 
-	creq, err := http.NewRequest(request.Method, request.URL.String(), request.Body)
+	body := &countingReader{r: request.Body}
+
+	creq, err := http.NewRequest(request.Method, request.URL.String(), body)
 	if err != nil {
-		log.Print(requestID, "| NewRequest error: ", err)
+		record.ErrorClass = "gen"
+		record.Err = err.Error()
+		record.Status = http.StatusBadGateway
 		rh.Add("Content-Type", "text/plain")
 		response.WriteHeader(http.StatusBadGateway)
 		fmt.Fprintf(response, "New request error: %v", err)
@@ -155,80 +452,123 @@ func handleRequest(requestID uint64, client *http.Client, response http.Response
 	creq.Header = request.Header
 	delete(creq.Header, "Proxy-Connection")
 
-	//client := &http.Client{}
-	cresp, err := client.Do(creq)
+	cresp, err := runRequestRewriters(p.requestRewriters, creq)
 	if err != nil {
-		log.Print(requestID, "| Request error: ", err)
+		record.ErrorClass = "gen"
+		record.Err = err.Error()
+		record.Status = http.StatusBadGateway
 		rh.Add("Content-Type", "text/plain")
 		response.WriteHeader(http.StatusBadGateway)
-		fmt.Fprintf(response, "Request error: %v", err)
+		fmt.Fprintf(response, "Request rewrite error: %v", err)
 		return
 	}
 
+	if cresp == nil {
+		var dialDone, firstByte time.Time
+
+		start := time.Now()
+		trace := &httptrace.ClientTrace{
+			ConnectDone: func(network, addr string, err error) {
+				if err == nil {
+					dialDone = time.Now()
+				}
+			},
+			GotFirstResponseByte: func() {
+				firstByte = time.Now()
+			},
+		}
+
+		creq = creq.WithContext(httptrace.WithClientTrace(creq.Context(), trace))
+
+		cresp, err = p.client.Do(creq)
+
+		if !dialDone.IsZero() {
+			record.DialTime = dialDone.Sub(start)
+		}
+
+		if err != nil {
+			record.BytesIn = body.n
+			record.ErrorClass = classifyDialError(err)
+			record.Err = err.Error()
+			record.Status = http.StatusBadGateway
+			rh.Add("Content-Type", "text/plain")
+			response.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintf(response, "Request error: %v", err)
+			return
+		}
+
+		if !firstByte.IsZero() {
+			record.TTFB = firstByte.Sub(start)
+		}
+	}
+
+	record.BytesIn = body.n
+
 	// we are expected to close body
 	defer cresp.Body.Close()
 
+	if err := runResponseRewriters(p.responseRewriters, cresp); err != nil {
+		record.ErrorClass = "gen"
+		record.Err = err.Error()
+		record.Status = http.StatusBadGateway
+		rh.Add("Content-Type", "text/plain")
+		response.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(response, "Response rewrite error: %v", err)
+		return
+	}
+
 	// copy response headers
 	for key, value := range cresp.Header {
 		rh[key] = value
 	}
 
-	// ignoring errors from this point
 	response.WriteHeader(cresp.StatusCode)
+	record.Status = cresp.StatusCode
 
-	io.Copy(response, cresp.Body)
+	written, _ := io.Copy(response, cresp.Body)
+	record.BytesOut = written
 }
 
-func handleWebsocket(requestID uint64, dialer *net.Dialer, response http.ResponseWriter, request *http.Request) {
+func (p *proxii) handleWebsocket(record *Record, response http.ResponseWriter, request *http.Request) {
 	rh := response.Header()
 
-	conn, err := dialer.Dial("tcp", request.Host)
-	if err != nil {
-		if neterror, ok := err.(*net.OpError); ok {
-			switch realerror := neterror.Err.(type) {
-			case *net.DNSError:
-				log.Print(requestID, "| WSConnect error(dns): ", realerror.Error())
+	dialStart := time.Now()
+	originConn, originHandshake, err := dialWebsocketOrigin(request.Context(), p.dialUpstream, request)
+	record.DialTime = time.Since(dialStart)
 
-			default:
-				log.Print(requestID, "| WSConnect error:(net)", realerror.Error())
-			}
-		} else {
-			log.Print(requestID, "| WSConnect error(gen): ", err)
-		}
+	if err != nil {
+		record.ErrorClass = classifyDialError(err)
+		record.Err = err.Error()
+		record.Status = http.StatusBadGateway
 		rh.Add("Content-Type", "text/plain")
 		response.WriteHeader(http.StatusBadGateway)
 		fmt.Fprintf(response, "WSConnect error: %v", err)
 		return
 	}
 
-	defer conn.Close()
+	defer originConn.Close()
 
-	request.URL.Scheme = "ws"
-	request.URL.Host = request.Host
+	upgrader := websocket.Upgrader{
+		EnableCompression: true,
+		CheckOrigin:       func(*http.Request) bool { return true },
+	}
 
-	// well, theoretically httputil.DumpRequest shouldn't be used... but it works
-	reconstructedResponse, err := httputil.DumpRequest(request, false)
+	clientConn, err := upgrader.Upgrade(response, request, negotiatedSubprotocolHeader(originHandshake))
 	if err != nil {
-		log.Print("cannot reconstruct:", err)
-		rh.Add("Content-Type", "text/plain")
-		response.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(response, "WSConnect dump error: %v", err)
+		// the upgrader already replied to the client on error
+		record.ErrorClass = "gen"
+		record.Err = err.Error()
 		return
 	}
 
-	hijacker, _ := response.(http.Hijacker)
-	clientConn, clientRw, err := hijacker.Hijack()
-
 	defer clientConn.Close()
 
-	log.Print(requestID, "| WSConnect success")
-
-	conn.Write(reconstructedResponse)
-
-	log.Print(requestID, "| WSConnect Wrote header")
+	record.Status = http.StatusSwitchingProtocols
 
-	// handshake and such handled directly between interested parties
+	untrack := p.trackTunnel(record.RequestID, request.Host, clientConn.UnderlyingConn())
+	defer untrack()
 
-	go io.Copy(conn, clientRw)
-	io.Copy(clientRw, conn)
+	up, down := pumpWebsocket(request.Context(), record, clientConn, originConn, p.wsMessageHook)
+	record.BytesIn = up
+	record.BytesOut = down
 }
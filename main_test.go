@@ -245,8 +245,6 @@ func runTests(t *testing.T, urlBase string, httpClient *http.Client, wsDialer *w
 		},
 	}
 
-	// @todo add test to verify when client disconnects, proxii closes the other end connection too.
-	// @todo add test to verify when client "shutdown" write, proxii continues to work normally (sending back response)
 	// @todo add "CONNECT" tests
 	// @todo add errored WebSocket tests
 	for _, testList := range [][]testData{commonTests, extraTests} {
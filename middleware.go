@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// RequestRewriter runs, in registration order, before the proxied request
+// is sent upstream. It may mutate request in place (headers, URL). If it
+// returns a non-nil *http.Response, the chain stops and that response is
+// used as-is (the upstream is never called); a non-nil error aborts the
+// request with a 502, same as an upstream dial failure.
+type RequestRewriter func(request *http.Request) (*http.Response, error)
+
+// ResponseRewriter runs, in registration order, after the upstream response
+// comes back but before its body is copied to the client. It may mutate
+// response in place, including replacing response.Body to stream-transform
+// it (e.g. gzip on the fly).
+type ResponseRewriter func(response *http.Response) error
+
+// UseRequestRewriter appends rw to the request-rewriting chain run by
+// handleRequest before client.Do.
+func (p *proxii) UseRequestRewriter(rw RequestRewriter) {
+	p.requestRewriters = append(p.requestRewriters, rw)
+}
+
+// UseResponseRewriter appends rw to the response-rewriting chain run by
+// handleRequest after the upstream responds, before the body is streamed to
+// the client.
+func (p *proxii) UseResponseRewriter(rw ResponseRewriter) {
+	p.responseRewriters = append(p.responseRewriters, rw)
+}
+
+// hopByHopHeaders is the RFC 7230 §6.1 set of header fields meaningful only
+// for a single transport-level connection and thus never forwarded.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// StripHopByHop removes the RFC 7230 hop-by-hop header set from the
+// request, including any extra fields named by the client in its
+// Connection header.
+func StripHopByHop() RequestRewriter {
+	return func(request *http.Request) (*http.Response, error) {
+		for _, field := range strings.Split(request.Header.Get("Connection"), ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				request.Header.Del(field)
+			}
+		}
+
+		for _, header := range hopByHopHeaders {
+			request.Header.Del(header)
+		}
+
+		return nil, nil
+	}
+}
+
+// AddVia adds a standard Via header entry identifying this hop, as
+// described by RFC 7230 §5.7.1.
+func AddVia(pseudonym string) RequestRewriter {
+	return func(request *http.Request) (*http.Response, error) {
+		via := request.Proto + " " + pseudonym
+		if existing := request.Header.Get("Via"); existing != "" {
+			via = existing + ", " + via
+		}
+
+		request.Header.Set("Via", via)
+
+		return nil, nil
+	}
+}
+
+// runRequestRewriters runs rewriters in order, stopping at the first one
+// that short-circuits (returns a non-nil response) or errors.
+func runRequestRewriters(rewriters []RequestRewriter, request *http.Request) (*http.Response, error) {
+	for _, rewriter := range rewriters {
+		response, err := rewriter(request)
+		if err != nil {
+			return nil, err
+		}
+
+		if response != nil {
+			return response, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// runResponseRewriters runs rewriters in order, stopping at the first error.
+func runResponseRewriters(rewriters []ResponseRewriter, response *http.Response) error {
+	for _, rewriter := range rewriters {
+		if err := rewriter(response); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newSyntheticResponse builds an *http.Response suitable for a
+// RequestRewriter short-circuit, with a plain-text body.
+func newSyntheticResponse(request *http.Request, status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Proto:      request.Proto,
+		ProtoMajor: request.ProtoMajor,
+		ProtoMinor: request.ProtoMinor,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    request,
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStripHopByHop(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	request.Header.Set("Connection", "X-Custom, Keep-Alive")
+	request.Header.Set("X-Custom", "should be stripped")
+	request.Header.Set("Proxy-Authorization", "should be stripped")
+	request.Header.Set("X-Keep", "should survive")
+
+	response, err := StripHopByHop()(request)
+	if err != nil || response != nil {
+		t.Fatalf("StripHopByHop() = %v, %v, want nil, nil", response, err)
+	}
+
+	for _, header := range []string{"Connection", "X-Custom", "Proxy-Authorization"} {
+		if request.Header.Get(header) != "" {
+			t.Errorf("Header %q = %q, want stripped", header, request.Header.Get(header))
+		}
+	}
+
+	if request.Header.Get("X-Keep") != "should survive" {
+		t.Errorf("Header X-Keep was stripped, want kept")
+	}
+}
+
+func TestAddVia(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	request.Proto = "HTTP/1.1"
+
+	if _, err := AddVia("proxii")(request); err != nil {
+		t.Fatal("AddVia error:", err)
+	}
+
+	if got, want := request.Header.Get("Via"), "HTTP/1.1 proxii"; got != want {
+		t.Errorf("Via = %q, want %q", got, want)
+	}
+
+	if _, err := AddVia("second-hop")(request); err != nil {
+		t.Fatal("AddVia error:", err)
+	}
+
+	if got, want := request.Header.Get("Via"), "HTTP/1.1 proxii, HTTP/1.1 second-hop"; got != want {
+		t.Errorf("Via = %q, want %q", got, want)
+	}
+}
+
+func TestRunRequestRewritersShortCircuits(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+
+	var ranSecond bool
+
+	short := newSyntheticResponse(request, http.StatusForbidden, "blocked")
+
+	rewriters := []RequestRewriter{
+		func(*http.Request) (*http.Response, error) { return short, nil },
+		func(*http.Request) (*http.Response, error) {
+			ranSecond = true
+			return nil, nil
+		},
+	}
+
+	response, err := runRequestRewriters(rewriters, request)
+	if err != nil {
+		t.Fatal("runRequestRewriters error:", err)
+	}
+
+	if response != short {
+		t.Errorf("runRequestRewriters returned %v, want the short-circuit response", response)
+	}
+
+	if ranSecond {
+		t.Error("runRequestRewriters ran a rewriter after one short-circuited")
+	}
+}
+
+func TestRunRequestRewritersStopsOnError(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+
+	wantErr := errors.New("boom")
+
+	var ranSecond bool
+
+	rewriters := []RequestRewriter{
+		func(*http.Request) (*http.Response, error) { return nil, wantErr },
+		func(*http.Request) (*http.Response, error) {
+			ranSecond = true
+			return nil, nil
+		},
+	}
+
+	if _, err := runRequestRewriters(rewriters, request); err != wantErr {
+		t.Errorf("runRequestRewriters error = %v, want %v", err, wantErr)
+	}
+
+	if ranSecond {
+		t.Error("runRequestRewriters ran a rewriter after one errored")
+	}
+}
+
+func TestRunResponseRewritersStopsOnError(t *testing.T) {
+	response := &http.Response{Header: make(http.Header)}
+
+	wantErr := errors.New("boom")
+
+	var ranSecond bool
+
+	rewriters := []ResponseRewriter{
+		func(*http.Response) error { return wantErr },
+		func(*http.Response) error {
+			ranSecond = true
+			return nil
+		},
+	}
+
+	if err := runResponseRewriters(rewriters, response); err != wantErr {
+		t.Errorf("runResponseRewriters error = %v, want %v", err, wantErr)
+	}
+
+	if ranSecond {
+		t.Error("runResponseRewriters ran a rewriter after one errored")
+	}
+}
+
+func TestNewSyntheticResponse(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	request.Proto = "HTTP/1.1"
+	request.ProtoMajor = 1
+	request.ProtoMinor = 1
+
+	response := newSyntheticResponse(request, http.StatusTeapot, "I'm a teapot")
+
+	if response.StatusCode != http.StatusTeapot {
+		t.Errorf("StatusCode = %d, want %d", response.StatusCode, http.StatusTeapot)
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal("ReadAll error:", err)
+	}
+
+	if string(body) != "I'm a teapot" {
+		t.Errorf("Body = %q, want %q", body, "I'm a teapot")
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProxyChainForHost(t *testing.T) {
+	chain, err := NewProxyChain([]string{"socks5://a:1080", "http://b:3128"}, []string{"*.bypass.example"})
+	if err != nil {
+		t.Fatal("NewProxyChain error:", err)
+	}
+
+	if err := chain.AddRule("*.internal.example", 1); err != nil {
+		t.Fatal("AddRule error:", err)
+	}
+
+	tests := []struct {
+		host string
+		want string // want.Host of the selected proxy, or "" for direct
+	}{
+		{"www.example.com", "a:1080"},
+		{"foo.internal.example", "b:3128"},
+		{"skip.bypass.example", ""},
+	}
+
+	for _, test := range tests {
+		got := chain.forHost(test.host)
+		switch {
+		case test.want == "" && got != nil:
+			t.Errorf("forHost(%q) = %v, want direct (nil)", test.host, got)
+		case test.want != "" && (got == nil || got.Host != test.want):
+			t.Errorf("forHost(%q) = %v, want proxy %q", test.host, got, test.want)
+		}
+	}
+}
+
+func TestNewProxyChainRejectsUnsupportedScheme(t *testing.T) {
+	if _, err := NewProxyChain([]string{"ftp://x"}, nil); err == nil {
+		t.Error("Expected an error for an unsupported upstream scheme")
+	}
+}
+
+// newFakeSOCKS5Server starts a listener that speaks just enough RFC 1928 (and,
+// if requireAuth is set, RFC 1929) SOCKS5 to satisfy dialSOCKS5, then hands
+// the connection to an echo loop so the test can verify bytes flow through it.
+func newFakeSOCKS5Server(t *testing.T, requireAuth bool) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot start fake SOCKS5 server:", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveFakeSOCKS5(conn, requireAuth)
+		}
+	}()
+
+	return listener
+}
+
+func serveFakeSOCKS5(conn net.Conn, requireAuth bool) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return
+	}
+
+	selected := byte(socks5AuthNone)
+	if requireAuth {
+		selected = socks5AuthPassword
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, selected}); err != nil {
+		return
+	}
+
+	if requireAuth {
+		authHeader := make([]byte, 2)
+		if _, err := io.ReadFull(reader, authHeader); err != nil {
+			return
+		}
+
+		username := make([]byte, authHeader[1])
+		if _, err := io.ReadFull(reader, username); err != nil {
+			return
+		}
+
+		passLen := make([]byte, 1)
+		if _, err := io.ReadFull(reader, passLen); err != nil {
+			return
+		}
+
+		password := make([]byte, passLen[0])
+		if _, err := io.ReadFull(reader, password); err != nil {
+			return
+		}
+
+		status := byte(0x00)
+		if string(username) != "user" || string(password) != "pass" {
+			status = 0x01
+		}
+
+		if _, err := conn.Write([]byte{0x01, status}); err != nil || status != 0x00 {
+			return
+		}
+	}
+
+	connectHeader := make([]byte, 4)
+	if _, err := io.ReadFull(reader, connectHeader); err != nil {
+		return
+	}
+
+	if connectHeader[3] == socks5AddrDomain {
+		lengthByte := make([]byte, 1)
+		if _, err := io.ReadFull(reader, lengthByte); err != nil {
+			return
+		}
+
+		target := make([]byte, int(lengthByte[0])+2) // + port
+		if _, err := io.ReadFull(reader, target); err != nil {
+			return
+		}
+	}
+
+	reply := []byte{socks5Version, 0x00, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := conn.Write(reply); err != nil {
+		return
+	}
+
+	io.Copy(conn, conn)
+}
+
+func TestDialSOCKS5NoAuth(t *testing.T) {
+	server := newFakeSOCKS5Server(t, false)
+	defer server.Close()
+
+	proxyURL, _ := url.Parse("socks5://" + server.Addr().String())
+
+	conn, err := dialSOCKS5(context.Background(), &net.Dialer{}, proxyURL, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatal("dialSOCKS5 error:", err)
+	}
+	defer conn.Close()
+
+	assertEcho(t, conn)
+}
+
+func TestDialSOCKS5WithAuth(t *testing.T) {
+	server := newFakeSOCKS5Server(t, true)
+	defer server.Close()
+
+	proxyURL, _ := url.Parse("socks5://user:pass@" + server.Addr().String())
+
+	conn, err := dialSOCKS5(context.Background(), &net.Dialer{}, proxyURL, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatal("dialSOCKS5 error:", err)
+	}
+	defer conn.Close()
+
+	assertEcho(t, conn)
+}
+
+func TestDialSOCKS5AuthRejected(t *testing.T) {
+	server := newFakeSOCKS5Server(t, true)
+	defer server.Close()
+
+	proxyURL, _ := url.Parse("socks5://user:wrong@" + server.Addr().String())
+
+	if _, err := dialSOCKS5(context.Background(), &net.Dialer{}, proxyURL, "tcp", "example.com:443"); err == nil {
+		t.Error("Expected dialSOCKS5 to fail with a rejected password")
+	}
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal("Write error:", err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal("Read error:", err)
+	}
+
+	if string(buf) != "ping" {
+		t.Errorf("Echo = %q, want %q", buf, "ping")
+	}
+}
+
+// newFakeHTTPConnectServer starts a listener that replies to a single CONNECT
+// request with statusCode, then (if it was 200) echoes whatever it receives
+// afterwards so the test can verify the tunnel is actually usable.
+func newFakeHTTPConnectServer(t *testing.T, statusCode int) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot start fake HTTP CONNECT server:", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				if _, err := http.ReadRequest(reader); err != nil {
+					return
+				}
+
+				fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n\r\n", statusCode, http.StatusText(statusCode))
+
+				if statusCode == http.StatusOK {
+					io.Copy(conn, conn)
+				}
+			}(conn)
+		}
+	}()
+
+	return listener
+}
+
+func TestDialHTTPConnectSuccess(t *testing.T) {
+	server := newFakeHTTPConnectServer(t, http.StatusOK)
+	defer server.Close()
+
+	proxyURL, _ := url.Parse("http://" + server.Addr().String())
+
+	conn, err := dialHTTPConnect(context.Background(), &net.Dialer{}, proxyURL, "example.com:443")
+	if err != nil {
+		t.Fatal("dialHTTPConnect error:", err)
+	}
+	defer conn.Close()
+
+	assertEcho(t, conn)
+}
+
+func TestDialHTTPConnectRefused(t *testing.T) {
+	server := newFakeHTTPConnectServer(t, http.StatusForbidden)
+	defer server.Close()
+
+	proxyURL, _ := url.Parse("http://" + server.Addr().String())
+
+	if _, err := dialHTTPConnect(context.Background(), &net.Dialer{}, proxyURL, "example.com:443"); err == nil {
+		t.Error("Expected dialHTTPConnect to fail when the upstream refuses CONNECT")
+	}
+}
+
+func TestDialHTTPConnectHonorsContextDeadline(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot start listener:", err)
+	}
+
+	listener := &closeSignalingListener{Listener: inner, closed: make(chan struct{})}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// Read the CONNECT request but never answer it.
+		http.ReadRequest(bufio.NewReader(conn))
+		<-listener.closed
+	}()
+
+	proxyURL, _ := url.Parse("http://" + listener.Addr().String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = dialHTTPConnect(ctx, &net.Dialer{}, proxyURL, "example.com:443")
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("Expected dialHTTPConnect to fail when the upstream never answers CONNECT")
+	}
+
+	if elapsed > time.Second {
+		t.Errorf("dialHTTPConnect took %s to fail, want it to honor the ~200ms context deadline", elapsed)
+	}
+}
+
+// closeSignalingListener wraps a net.Listener and closes its closed channel
+// once, when Close is called, so a goroutine serving an accepted connection
+// can be told to stop waiting and tear the connection down.
+type closeSignalingListener struct {
+	net.Listener
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *closeSignalingListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// rewriteRulesYAMLExts are the file extensions treated as YAML rule files;
+// anything else is parsed as JSON.
+var rewriteRulesYAMLExts = map[string]bool{".yaml": true, ".yml": true}
+
+// RewriteRule matches requests by host glob, path regex and/or method, and
+// applies Action to the ones that match. An empty matcher field matches
+// everything.
+type RewriteRule struct {
+	Host   string        `json:"host,omitempty"`
+	Path   string        `json:"path,omitempty"`
+	Method string        `json:"method,omitempty"`
+	Action RewriteAction `json:"action"`
+
+	pathRegexp *regexp.Regexp
+}
+
+// RewriteAction is what happens to a request matched by a RewriteRule.
+type RewriteAction struct {
+	SetHeader          map[string]string `json:"set_header,omitempty"`
+	RemoveHeader       []string          `json:"remove_header,omitempty"`
+	RewriteHost        string            `json:"rewrite_host,omitempty"`
+	ShortCircuitStatus int               `json:"short_circuit_status,omitempty"`
+	ShortCircuitBody   string            `json:"short_circuit_body,omitempty"`
+}
+
+// LoadRewriteRules reads a list of RewriteRule from path and compiles their
+// path regexes. Files named *.yaml or *.yml are parsed as YAML (see
+// parseRewriteRulesYAML for the supported subset); anything else is parsed
+// as a JSON array.
+func LoadRewriteRules(rulesPath string) ([]*RewriteRule, error) {
+	data, err := os.ReadFile(rulesPath)
+	if err != nil {
+		return nil, fmt.Errorf("rewriterules: read %s: %w", rulesPath, err)
+	}
+
+	var rules []*RewriteRule
+	if rewriteRulesYAMLExts[strings.ToLower(path.Ext(rulesPath))] {
+		rules, err = parseRewriteRulesYAML(data)
+	} else {
+		err = json.Unmarshal(data, &rules)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rewriterules: parse %s: %w", rulesPath, err)
+	}
+
+	for _, rule := range rules {
+		if rule.Path == "" {
+			continue
+		}
+
+		rule.pathRegexp, err = regexp.Compile(rule.Path)
+		if err != nil {
+			return nil, fmt.Errorf("rewriterules: bad path regex %q: %w", rule.Path, err)
+		}
+	}
+
+	return rules, nil
+}
+
+func (rule *RewriteRule) matches(request *http.Request) bool {
+	if rule.Method != "" && !strings.EqualFold(rule.Method, request.Method) {
+		return false
+	}
+
+	if rule.Host != "" {
+		ok, err := path.Match(strings.ToLower(rule.Host), strings.ToLower(request.Host))
+		if err != nil || !ok {
+			return false
+		}
+	}
+
+	if rule.pathRegexp != nil && !rule.pathRegexp.MatchString(request.URL.Path) {
+		return false
+	}
+
+	return true
+}
+
+// UseRewriteRulesFile loads rules from rulesPath and registers them as a
+// RequestRewriter.
+func (p *proxii) UseRewriteRulesFile(rulesPath string) error {
+	rules, err := LoadRewriteRules(rulesPath)
+	if err != nil {
+		return err
+	}
+
+	p.UseRequestRewriter(NewRewriteRulesRequestRewriter(rules))
+
+	return nil
+}
+
+// NewRewriteRulesRequestRewriter turns a set of rules loaded by
+// LoadRewriteRules into a single RequestRewriter: only the first matching
+// rule's action is applied and later rules are not evaluated. The rewriter
+// chain stops only when that action short-circuits with a status.
+func NewRewriteRulesRequestRewriter(rules []*RewriteRule) RequestRewriter {
+	return func(request *http.Request) (*http.Response, error) {
+		for _, rule := range rules {
+			if !rule.matches(request) {
+				continue
+			}
+
+			action := rule.Action
+
+			for key, value := range action.SetHeader {
+				request.Header.Set(key, value)
+			}
+
+			for _, key := range action.RemoveHeader {
+				request.Header.Del(key)
+			}
+
+			if action.RewriteHost != "" {
+				request.Host = action.RewriteHost
+				request.URL.Host = action.RewriteHost
+			}
+
+			if action.ShortCircuitStatus != 0 {
+				return newSyntheticResponse(request, action.ShortCircuitStatus, action.ShortCircuitBody), nil
+			}
+
+			break
+		}
+
+		return nil, nil
+	}
+}
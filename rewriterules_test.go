@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestRewriteRuleMatches(t *testing.T) {
+	rule := &RewriteRule{Host: "*.example.com", Method: "GET"}
+	rule.pathRegexp = nil
+
+	tests := []struct {
+		method string
+		host   string
+		want   bool
+	}{
+		{"GET", "api.example.com", true},
+		{"get", "api.example.com", true}, // method is case-insensitive
+		{"POST", "api.example.com", false},
+		{"GET", "example.org", false},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(test.method, "http://"+test.host+"/", nil)
+		request.Host = test.host
+
+		if got := rule.matches(request); got != test.want {
+			t.Errorf("matches(%s %s) = %v, want %v", test.method, test.host, got, test.want)
+		}
+	}
+}
+
+func TestRewriteRuleMatchesPath(t *testing.T) {
+	rules, err := parseRewriteRulesYAML([]byte("- path: \"^/api/\"\n"))
+	if err != nil {
+		t.Fatal("parseRewriteRulesYAML error:", err)
+	}
+
+	rule := rules[0]
+	var compileErr error
+	rule.pathRegexp, compileErr = regexp.Compile(rule.Path)
+	if compileErr != nil {
+		t.Fatal("compile path regexp:", compileErr)
+	}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/api/users", true},
+		{"/other", false},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "http://example.com"+test.path, nil)
+		if got := rule.matches(request); got != test.want {
+			t.Errorf("matches(path=%s) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestNewRewriteRulesRequestRewriter(t *testing.T) {
+	rules := []*RewriteRule{
+		{
+			Host: "*.internal.example",
+			Action: RewriteAction{
+				SetHeader:    map[string]string{"X-Added": "1"},
+				RemoveHeader: []string{"X-Remove"},
+				RewriteHost:  "backend.internal.example",
+			},
+		},
+		{
+			Host: "blocked.example",
+			Action: RewriteAction{
+				ShortCircuitStatus: http.StatusForbidden,
+				ShortCircuitBody:   "nope",
+			},
+		},
+	}
+
+	rewrite := NewRewriteRulesRequestRewriter(rules)
+
+	request := httptest.NewRequest(http.MethodGet, "http://svc.internal.example/", nil)
+	request.Host = "svc.internal.example"
+	request.Header.Set("X-Remove", "bye")
+
+	response, err := rewrite(request)
+	if err != nil || response != nil {
+		t.Fatalf("rewrite() = %v, %v, want nil, nil", response, err)
+	}
+
+	if got := request.Header.Get("X-Added"); got != "1" {
+		t.Errorf("X-Added = %q, want %q", got, "1")
+	}
+
+	if got := request.Header.Get("X-Remove"); got != "" {
+		t.Errorf("X-Remove = %q, want removed", got)
+	}
+
+	if request.Host != "backend.internal.example" || request.URL.Host != "backend.internal.example" {
+		t.Errorf("Host rewrite = %q/%q, want backend.internal.example", request.Host, request.URL.Host)
+	}
+
+	blocked := httptest.NewRequest(http.MethodGet, "http://blocked.example/", nil)
+	blocked.Host = "blocked.example"
+
+	response, err = rewrite(blocked)
+	if err != nil {
+		t.Fatal("rewrite() error:", err)
+	}
+
+	if response == nil || response.StatusCode != http.StatusForbidden {
+		t.Fatalf("rewrite() response = %v, want a %d short-circuit", response, http.StatusForbidden)
+	}
+}
+
+func TestLoadRewriteRulesJSON(t *testing.T) {
+	dir := t.TempDir()
+	rulesPath := filepath.Join(dir, "rules.json")
+
+	const rulesJSON = `[
+		{
+			"host": "*.example.com",
+			"path": "^/api/",
+			"method": "GET",
+			"action": {"rewrite_host": "backend.example.com"}
+		}
+	]`
+
+	if err := os.WriteFile(rulesPath, []byte(rulesJSON), 0o644); err != nil {
+		t.Fatal("WriteFile error:", err)
+	}
+
+	rules, err := LoadRewriteRules(rulesPath)
+	if err != nil {
+		t.Fatal("LoadRewriteRules error:", err)
+	}
+
+	if len(rules) != 1 {
+		t.Fatalf("len(rules) = %d, want 1", len(rules))
+	}
+
+	if rules[0].Action.RewriteHost != "backend.example.com" {
+		t.Errorf("RewriteHost = %q, want %q", rules[0].Action.RewriteHost, "backend.example.com")
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "http://api.example.com/api/users", nil)
+	request.Host = "api.example.com"
+
+	if !rules[0].matches(request) {
+		t.Error("Expected the loaded rule to match the request")
+	}
+}
+
+func TestLoadRewriteRulesYAML(t *testing.T) {
+	dir := t.TempDir()
+	rulesPath := filepath.Join(dir, "rules.yaml")
+
+	const rulesYAML = `- host: "*.example.com"
+  path: "^/api/"
+  method: GET
+  action:
+    set_header:
+      X-Foo: bar
+    remove_header:
+      - X-Bar
+    rewrite_host: backend.example.com
+    short_circuit_status: 403
+    short_circuit_body: blocked
+`
+
+	if err := os.WriteFile(rulesPath, []byte(rulesYAML), 0o644); err != nil {
+		t.Fatal("WriteFile error:", err)
+	}
+
+	rules, err := LoadRewriteRules(rulesPath)
+	if err != nil {
+		t.Fatal("LoadRewriteRules error:", err)
+	}
+
+	if len(rules) != 1 {
+		t.Fatalf("len(rules) = %d, want 1", len(rules))
+	}
+
+	rule := rules[0]
+
+	if rule.Host != "*.example.com" || rule.Method != "GET" || rule.Path != "^/api/" {
+		t.Errorf("rule = %+v, want host/path/method populated", rule)
+	}
+
+	if rule.pathRegexp == nil || !rule.pathRegexp.MatchString("/api/users") {
+		t.Errorf("pathRegexp did not compile/match as expected: %v", rule.pathRegexp)
+	}
+
+	action := rule.Action
+	if action.SetHeader["X-Foo"] != "bar" {
+		t.Errorf("SetHeader[X-Foo] = %q, want %q", action.SetHeader["X-Foo"], "bar")
+	}
+
+	if len(action.RemoveHeader) != 1 || action.RemoveHeader[0] != "X-Bar" {
+		t.Errorf("RemoveHeader = %v, want [X-Bar]", action.RemoveHeader)
+	}
+
+	if action.RewriteHost != "backend.example.com" {
+		t.Errorf("RewriteHost = %q, want %q", action.RewriteHost, "backend.example.com")
+	}
+
+	if action.ShortCircuitStatus != 403 {
+		t.Errorf("ShortCircuitStatus = %d, want 403", action.ShortCircuitStatus)
+	}
+
+	if action.ShortCircuitBody != "blocked" {
+		t.Errorf("ShortCircuitBody = %q, want %q", action.ShortCircuitBody, "blocked")
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseRewriteRulesYAML parses the restricted YAML subset accepted for
+// rewrite rule files: a top-level block sequence of mappings shaped like
+//
+//	- host: "*.example.com"
+//	  path: "^/api"
+//	  method: GET
+//	  action:
+//	    set_header:
+//	      X-Foo: bar
+//	    remove_header:
+//	      - X-Bar
+//	    rewrite_host: internal.example.com
+//	    short_circuit_status: 403
+//	    short_circuit_body: blocked
+//
+// This intentionally is not a general-purpose YAML parser (no anchors, flow
+// style, multi-document streams or block scalars) -- the repo has no
+// go.mod/vendoring to pull in a real YAML library, and a rewrite rule file
+// only ever needs this shape.
+func parseRewriteRulesYAML(data []byte) ([]*RewriteRule, error) {
+	lines := splitYAMLLines(string(data))
+
+	var rules []*RewriteRule
+
+	i := 0
+	for i < len(lines) {
+		if !lines[i].isItem {
+			return nil, fmt.Errorf("rewriterules: line %d: expected a list item (\"- ...\")", lines[i].num)
+		}
+
+		rule := &RewriteRule{}
+		ruleIndent := lines[i].indent
+
+		if lines[i].content != "" {
+			if err := applyRuleField(rule, lines[i].content, lines[i].num); err != nil {
+				return nil, err
+			}
+		}
+		i++
+
+		for i < len(lines) && !lines[i].isItem && lines[i].indent == ruleIndent {
+			key, value, hasColon := splitYAMLKeyValue(lines[i].content)
+			if !hasColon {
+				return nil, fmt.Errorf("rewriterules: line %d: expected \"key: value\"", lines[i].num)
+			}
+
+			if key != "action" {
+				if err := applyRuleField(rule, lines[i].content, lines[i].num); err != nil {
+					return nil, err
+				}
+				i++
+				continue
+			}
+
+			if value != "" {
+				return nil, fmt.Errorf("rewriterules: line %d: \"action\" must introduce a nested block", lines[i].num)
+			}
+
+			i++
+			if err := parseYAMLAction(&rule.Action, lines, &i, ruleIndent); err != nil {
+				return nil, err
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func parseYAMLAction(action *RewriteAction, lines []yamlLine, i *int, ruleIndent int) error {
+	if *i >= len(lines) || lines[*i].indent <= ruleIndent {
+		return nil
+	}
+
+	actionIndent := lines[*i].indent
+
+	for *i < len(lines) && !lines[*i].isItem && lines[*i].indent == actionIndent {
+		key, value, hasColon := splitYAMLKeyValue(lines[*i].content)
+		if !hasColon {
+			return fmt.Errorf("rewriterules: line %d: expected \"key: value\"", lines[*i].num)
+		}
+
+		lineNum := lines[*i].num
+		*i++
+
+		switch key {
+		case "set_header":
+			if value != "" {
+				return fmt.Errorf("rewriterules: line %d: \"set_header\" must introduce a nested block", lineNum)
+			}
+
+			headers, err := parseYAMLStringMap(lines, i, actionIndent)
+			if err != nil {
+				return err
+			}
+
+			action.SetHeader = headers
+
+		case "remove_header":
+			if value != "" {
+				return fmt.Errorf("rewriterules: line %d: \"remove_header\" must introduce a nested list", lineNum)
+			}
+
+			action.RemoveHeader = parseYAMLStringList(lines, i, actionIndent)
+
+		case "rewrite_host":
+			action.RewriteHost = unquoteYAMLScalar(value)
+
+		case "short_circuit_status":
+			status, err := strconv.Atoi(unquoteYAMLScalar(value))
+			if err != nil {
+				return fmt.Errorf("rewriterules: line %d: bad short_circuit_status %q: %w", lineNum, value, err)
+			}
+
+			action.ShortCircuitStatus = status
+
+		case "short_circuit_body":
+			action.ShortCircuitBody = unquoteYAMLScalar(value)
+
+		default:
+			return fmt.Errorf("rewriterules: line %d: unknown action field %q", lineNum, key)
+		}
+	}
+
+	return nil
+}
+
+func parseYAMLStringMap(lines []yamlLine, i *int, parentIndent int) (map[string]string, error) {
+	if *i >= len(lines) || lines[*i].indent <= parentIndent {
+		return nil, nil
+	}
+
+	childIndent := lines[*i].indent
+	result := make(map[string]string)
+
+	for *i < len(lines) && !lines[*i].isItem && lines[*i].indent == childIndent {
+		key, value, hasColon := splitYAMLKeyValue(lines[*i].content)
+		if !hasColon {
+			return nil, fmt.Errorf("rewriterules: line %d: expected \"key: value\"", lines[*i].num)
+		}
+
+		result[key] = unquoteYAMLScalar(value)
+		*i++
+	}
+
+	return result, nil
+}
+
+func parseYAMLStringList(lines []yamlLine, i *int, parentIndent int) []string {
+	if *i >= len(lines) || lines[*i].indent <= parentIndent || !lines[*i].isItem {
+		return nil
+	}
+
+	childIndent := lines[*i].indent
+
+	var result []string
+	for *i < len(lines) && lines[*i].isItem && lines[*i].indent == childIndent {
+		result = append(result, unquoteYAMLScalar(lines[*i].content))
+		*i++
+	}
+
+	return result
+}
+
+// applyRuleField sets the RewriteRule top-level field (host/path/method)
+// named by a "key: value" line onto rule.
+func applyRuleField(rule *RewriteRule, content string, lineNum int) error {
+	key, value, hasColon := splitYAMLKeyValue(content)
+	if !hasColon {
+		return fmt.Errorf("rewriterules: line %d: expected \"key: value\"", lineNum)
+	}
+
+	value = unquoteYAMLScalar(value)
+
+	switch key {
+	case "host":
+		rule.Host = value
+	case "path":
+		rule.Path = value
+	case "method":
+		rule.Method = value
+	default:
+		return fmt.Errorf("rewriterules: line %d: unknown rule field %q", lineNum, key)
+	}
+
+	return nil
+}
+
+// yamlLine is one non-blank, comment-stripped line of a rule file, already
+// classified as a list item ("- ...") or a plain "key: value" mapping entry.
+type yamlLine struct {
+	num     int
+	indent  int // column where content starts (after "- " if isItem)
+	isItem  bool
+	content string
+}
+
+func splitYAMLLines(data string) []yamlLine {
+	var out []yamlLine
+
+	for num, raw := range strings.Split(data, "\n") {
+		line := stripYAMLComment(raw)
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		rest := line[indent:]
+
+		isItem := rest == "-" || strings.HasPrefix(rest, "- ")
+		if isItem {
+			rest = strings.TrimPrefix(rest, "-")
+			trimmed := strings.TrimLeft(rest, " ")
+			indent += 1 + (len(rest) - len(trimmed))
+			rest = trimmed
+		}
+
+		out = append(out, yamlLine{
+			num:     num + 1,
+			indent:  indent,
+			isItem:  isItem,
+			content: strings.TrimRight(rest, " \t\r"),
+		})
+	}
+
+	return out
+}
+
+// stripYAMLComment removes a trailing "# comment" from line. It does not
+// attempt to understand quoting, matching this loader's no-flow-style,
+// no-special-characters scope.
+func stripYAMLComment(line string) string {
+	if idx := strings.Index(line, "#"); idx >= 0 {
+		return line[:idx]
+	}
+
+	return line
+}
+
+// splitYAMLKeyValue splits a "key: value" (or bare "key:") mapping line.
+func splitYAMLKeyValue(content string) (key, value string, hasColon bool) {
+	idx := strings.Index(content, ":")
+	if idx < 0 {
+		return "", "", false
+	}
+
+	key = strings.TrimSpace(content[:idx])
+	value = strings.TrimSpace(content[idx+1:])
+
+	return key, value, true
+}
+
+// unquoteYAMLScalar strips a single layer of matching double or single
+// quotes from a scalar value, if present.
+func unquoteYAMLScalar(value string) string {
+	if len(value) >= 2 {
+		if (value[0] == '"' && value[len(value)-1] == '"') ||
+			(value[0] == '\'' && value[len(value)-1] == '\'') {
+			return value[1 : len(value)-1]
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const debugEndpointPath = "/debug/proxii"
+
+// tunnelInfo describes one hijacked CONNECT/WebSocket tunnel that http.Server
+// itself cannot see (hijacked conns are invisible to it), so Shutdown can
+// wait for it to drain and /debug/proxii can report it.
+type tunnelInfo struct {
+	RequestID uint64    `json:"request_id"`
+	Host      string    `json:"host"`
+	StartedAt time.Time `json:"started_at"`
+	conn      net.Conn
+}
+
+// trackTunnel records a hijacked tunnel as in-flight. The returned func
+// must be deferred to untrack it when the tunnel ends.
+func (p *proxii) trackTunnel(requestID uint64, host string, conn net.Conn) func() {
+	info := &tunnelInfo{RequestID: requestID, Host: host, StartedAt: time.Now(), conn: conn}
+	p.activeTunnels.Store(requestID, info)
+
+	return func() {
+		p.activeTunnels.Delete(requestID)
+	}
+}
+
+func (p *proxii) tunnelCount() int {
+	count := 0
+	p.activeTunnels.Range(func(_, _ interface{}) bool {
+		count++
+		return true
+	})
+
+	return count
+}
+
+func (p *proxii) forceCloseTunnels() {
+	p.activeTunnels.Range(func(key, value interface{}) bool {
+		value.(*tunnelInfo).conn.Close()
+		p.activeTunnels.Delete(key)
+		return true
+	})
+}
+
+// Shutdown stops proxii from accepting new connections, waits up to
+// ctx's deadline for tracked tunnels (CONNECT/WebSocket) and regular HTTP
+// requests to finish on their own, then force-closes whatever is left.
+func (p *proxii) Shutdown(ctx context.Context) error {
+	serverErr := p.server.Shutdown(ctx)
+
+	drained := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+
+		for p.tunnelCount() > 0 {
+			select {
+			case <-ctx.Done():
+				close(drained)
+				return
+			case <-ticker.C:
+			}
+		}
+
+		close(drained)
+	}()
+
+	<-drained
+
+	p.forceCloseTunnels()
+
+	if serverErr != nil {
+		// server.Shutdown gave up with requests still active: close them.
+		p.server.Close()
+	}
+
+	return serverErr
+}
+
+// acquireConnSlot enforces --max-conns and --max-conns-per-host, returning
+// false if the connection should be rejected with 503.
+func (p *proxii) acquireConnSlot(host string) bool {
+	if p.connSemaphore != nil {
+		select {
+		case p.connSemaphore <- struct{}{}:
+		default:
+			return false
+		}
+	}
+
+	if p.maxConnsPerHost > 0 {
+		sem := p.hostSemaphore(host)
+
+		select {
+		case sem <- struct{}{}:
+		default:
+			if p.connSemaphore != nil {
+				<-p.connSemaphore
+			}
+
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *proxii) releaseConnSlot(host string) {
+	if p.maxConnsPerHost > 0 {
+		sem := p.hostSemaphore(host)
+		select {
+		case <-sem:
+		default:
+		}
+	}
+
+	if p.connSemaphore != nil {
+		select {
+		case <-p.connSemaphore:
+		default:
+		}
+	}
+}
+
+func (p *proxii) hostSemaphore(host string) chan struct{} {
+	key := hostOnly(host)
+
+	existing, _ := p.hostSemaphores.LoadOrStore(key, make(chan struct{}, p.maxConnsPerHost))
+
+	return existing.(chan struct{})
+}
+
+// SetMaxConns limits the number of requests/tunnels proxii serves
+// concurrently. A value of 0 removes the limit.
+func (p *proxii) SetMaxConns(max int) {
+	if max <= 0 {
+		p.connSemaphore = nil
+		return
+	}
+
+	p.connSemaphore = make(chan struct{}, max)
+}
+
+// SetMaxConnsPerHost limits the number of requests/tunnels proxii serves
+// concurrently to any single upstream host. A value of 0 removes the limit.
+func (p *proxii) SetMaxConnsPerHost(max int) {
+	p.maxConnsPerHost = max
+	p.hostSemaphores = sync.Map{}
+}
+
+func (p *proxii) serveDebugEndpoint(response http.ResponseWriter) {
+	type entry struct {
+		RequestID uint64    `json:"request_id"`
+		Host      string    `json:"host"`
+		StartedAt time.Time `json:"started_at"`
+	}
+
+	entries := make([]entry, 0)
+
+	p.activeTunnels.Range(func(_, value interface{}) bool {
+		info := value.(*tunnelInfo)
+		entries = append(entries, entry{RequestID: info.RequestID, Host: info.Host, StartedAt: info.StartedAt})
+		return true
+	})
+
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(entries)
+}
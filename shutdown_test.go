@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestShutdownDrainsTunnel verifies that Shutdown waits for an in-flight
+// CONNECT tunnel to finish on its own (rather than force-closing it
+// immediately) as long as it drains before the context deadline.
+func TestShutdownDrainsTunnel(t *testing.T) {
+	recvEOF := make(chan struct{}, 1)
+	origin := newEchoTCPServer(t, "", recvEOF)
+	defer origin.Close()
+
+	proxii, err := newProxii("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot start proxii:", err)
+	}
+
+	go proxii.serve()
+
+	clientConn := connectThroughProxii(t, proxii.listener.Addr().String(), origin.Addr().String())
+	defer clientConn.Close()
+
+	// give handleConnect a moment to register the tunnel before we start
+	// shutting down.
+	time.Sleep(50 * time.Millisecond)
+
+	if got := proxii.tunnelCount(); got != 1 {
+		t.Fatalf("tunnelCount() = %d, want 1", got)
+	}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		if err := proxii.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown error: %v", err)
+		}
+
+		close(shutdownDone)
+	}()
+
+	// Shutdown must not return while the tunnel is still open.
+	select {
+	case <-shutdownDone:
+		t.Fatal("Shutdown returned before the tunnel drained")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	clientConn.Close()
+
+	select {
+	case <-recvEOF:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Origin did not observe EOF after client disconnect")
+	}
+
+	select {
+	case <-shutdownDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not return after the tunnel drained")
+	}
+
+	if got := proxii.tunnelCount(); got != 0 {
+		t.Errorf("tunnelCount() after Shutdown = %d, want 0", got)
+	}
+}
+
+// TestMaxConnsRejects verifies that once --max-conns' limit is saturated,
+// ServeHTTP replies 503 with a Retry-After header instead of serving the
+// request.
+func TestMaxConnsRejects(t *testing.T) {
+	testServer, err := newTestingWebServer()
+	if err != nil {
+		t.Fatal("TestingWebServer cannot start", err)
+	}
+	defer testServer.close()
+
+	proxii, err := newProxii("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot start proxii:", err)
+	}
+	defer proxii.close()
+
+	proxii.SetMaxConns(1)
+
+	go proxii.serve()
+
+	// hold the one available slot open with a CONNECT tunnel.
+	echoRecvEOF := make(chan struct{}, 1)
+	echoOrigin := newEchoTCPServer(t, "", echoRecvEOF)
+	defer echoOrigin.Close()
+
+	holder := connectThroughProxii(t, proxii.listener.Addr().String(), echoOrigin.Addr().String())
+	defer holder.Close()
+
+	proxiiURL, err := url.Parse("http://" + proxii.listener.Addr().String())
+	if err != nil {
+		t.Fatal("Proxy URL is bad:", err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: func(*http.Request) (*url.URL, error) { return proxiiURL, nil }},
+	}
+
+	resp, err := client.Get(testServer.urlBase + "/get")
+	if err != nil {
+		t.Fatal("Request through proxii failed:", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header on the 503 response")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// singleConnListener is a net.Listener that yields exactly one connection;
+// every later Accept (or one made after Close) fails immediately so
+// http.Server.Serve's accept loop returns right away instead of blocking
+// forever on a second connection that will never come. It lets Serve drive
+// a single already-established (and already TLS-terminated) connection,
+// which is how handleInterceptedConnect reuses handleRequest for MITM'd
+// traffic; callers that need to wait for that one connection to actually
+// finish (not just for Serve to return) must synchronize separately, e.g.
+// via http.Server.ConnState.
+type singleConnListener struct {
+	conn net.Conn
+
+	once     sync.Once
+	accepted chan struct{}
+	closed   chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{
+		conn:     conn,
+		accepted: make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, errors.New("singleconnlistener: closed")
+	default:
+	}
+
+	select {
+	case <-l.accepted:
+		return nil, errors.New("singleconnlistener: closed")
+	default:
+	}
+
+	close(l.accepted)
+
+	return l.conn, nil
+}
+
+func (l *singleConnListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+)
+
+// dialSOCKS5 dials addr through the SOCKS5 upstream described by proxyURL,
+// performing the RFC 1928 greeting (and RFC 1929 username/password
+// authentication, if proxyURL carries credentials) followed by a CONNECT
+// request for addr. On success the returned conn is ready to carry the
+// target's traffic.
+func dialSOCKS5(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, network, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, network, proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: dial upstream %s: %w", proxyURL.Host, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if err := socks5Handshake(conn, proxyURL, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func socks5Handshake(conn net.Conn, proxyURL *url.URL, addr string) error {
+	methods := []byte{socks5AuthNone}
+	if proxyURL.User != nil {
+		methods = []byte{socks5AuthPassword}
+	}
+
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("socks5: greeting: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(reader, reply); err != nil {
+		return fmt.Errorf("socks5: greeting reply: %w", err)
+	}
+
+	if reply[0] != socks5Version {
+		return fmt.Errorf("socks5: unexpected server version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+		// nothing to do
+
+	case socks5AuthPassword:
+		if err := socks5Authenticate(reader, conn, proxyURL); err != nil {
+			return err
+		}
+
+	case socks5AuthNoAccept:
+		return errors.New("socks5: no acceptable authentication method")
+
+	default:
+		return fmt.Errorf("socks5: server selected unsupported auth method %d", reply[1])
+	}
+
+	return socks5Connect(reader, conn, addr)
+}
+
+func socks5Authenticate(reader *bufio.Reader, conn net.Conn, proxyURL *url.URL) error {
+	username := proxyURL.User.Username()
+	password, _ := proxyURL.User.Password()
+
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("socks5: username/password too long for RFC 1929")
+	}
+
+	request := make([]byte, 0, 3+len(username)+len(password))
+	request = append(request, 0x01, byte(len(username)))
+	request = append(request, username...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("socks5: auth request: %w", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(reader, reply); err != nil {
+		return fmt.Errorf("socks5: auth reply: %w", err)
+	}
+
+	if reply[1] != 0x00 {
+		return fmt.Errorf("socks5: authentication failed (status %d)", reply[1])
+	}
+
+	return nil
+}
+
+func socks5Connect(reader *bufio.Reader, conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("socks5: bad target address %q: %w", addr, err)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("socks5: bad target port %q: %w", portStr, err)
+	}
+
+	request := []byte{socks5Version, socks5CmdConnect, 0x00}
+
+	switch {
+	case len(host) <= 255:
+		request = append(request, socks5AddrDomain, byte(len(host)))
+		request = append(request, host...)
+
+	default:
+		return fmt.Errorf("socks5: target host %q too long", host)
+	}
+
+	request = append(request, byte(port>>8), byte(port))
+
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("socks5: connect request: %w", err)
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return fmt.Errorf("socks5: connect reply: %w", err)
+	}
+
+	if header[1] != 0x00 {
+		return fmt.Errorf("socks5: connect refused (reply code %d)", header[1])
+	}
+
+	var skip int
+
+	switch header[3] {
+	case socks5AddrIPv4:
+		skip = net.IPv4len
+	case socks5AddrIPv6:
+		skip = net.IPv6len
+	case socks5AddrDomain:
+		lengthByte := make([]byte, 1)
+		if _, err := io.ReadFull(reader, lengthByte); err != nil {
+			return fmt.Errorf("socks5: connect reply domain length: %w", err)
+		}
+		skip = int(lengthByte[0])
+	default:
+		return fmt.Errorf("socks5: connect reply unknown address type %d", header[3])
+	}
+
+	// bound address + port, discarded: proxii only needs the connection itself
+	if _, err := io.CopyN(ioutil.Discard, reader, int64(skip+2)); err != nil {
+		return fmt.Errorf("socks5: connect reply bound address: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+// Package tunnel shuttles bytes between two already-connected net.Conns,
+// the way proxii's CONNECT and WebSocket handlers do once a tunnel is
+// established.
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+// closeWriter is implemented by *net.TCPConn and most hijacked
+// *http.conn-backed connections: it lets us propagate a FIN on one
+// direction without tearing down the other.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type pumpResult struct {
+	n   int64
+	err error
+}
+
+// Pump copies bytes from a to b and from b to a concurrently until both
+// directions finish. When one direction hits EOF it calls CloseWrite on the
+// peer it was writing to (if the peer supports half-close) so the FIN
+// propagates instead of the other direction hanging until its own read
+// times out. If ctx is canceled before both directions finish, a and b are
+// both closed to unblock the pending reads. It returns the byte counts
+// copied in each direction and an error: the a-to-b direction's error if it
+// had one, otherwise the b-to-a direction's, otherwise nil.
+func Pump(ctx context.Context, a, b net.Conn) (aToB, bToA int64, err error) {
+	aToBc := make(chan pumpResult, 1)
+	bToAc := make(chan pumpResult, 1)
+
+	go func() {
+		n, copyErr := io.Copy(b, a)
+		if cw, ok := b.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+		aToBc <- pumpResult{n, copyErr}
+	}()
+
+	go func() {
+		n, copyErr := io.Copy(a, b)
+		if cw, ok := a.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+		bToAc <- pumpResult{n, copyErr}
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			a.Close()
+			b.Close()
+		case <-done:
+		}
+	}()
+
+	r1 := <-aToBc
+	r2 := <-bToAc
+
+	err = r1.err
+	if err == nil {
+		err = r2.err
+	}
+
+	return r1.n, r2.n, err
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// connectThroughProxii opens a raw TCP connection to proxyAddr, issues a
+// CONNECT to origin and returns the raw client connection once the proxy
+// has replied "200 Connection established". The caller drives the tunnel
+// directly so it can exercise half-close/disconnect behavior that the
+// net/http client API hides.
+func connectThroughProxii(t *testing.T, proxyAddr, origin string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal("Cannot dial proxii:", err)
+	}
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", origin, origin)
+
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal("Cannot read CONNECT response:", err)
+	}
+
+	if status != "HTTP/1.1 200 Connection established\r\n" {
+		t.Fatalf("Unexpected CONNECT response: %q", status)
+	}
+
+	return conn
+}
+
+// newEchoTCPServer starts a listener that, for each accepted connection,
+// echoes back anything it reads until EOF, then writes trailingMessage (if
+// any) and closes. It reports each accepted connection's local observation
+// of EOF on recvEOF, so tests can assert a disconnect propagated promptly.
+func newEchoTCPServer(t *testing.T, trailingMessage string, recvEOF chan<- struct{}) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot start echo server:", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				buf := make([]byte, 4096)
+				for {
+					n, err := conn.Read(buf)
+					if n > 0 {
+						conn.Write(buf[:n])
+					}
+
+					if err != nil {
+						if recvEOF != nil {
+							recvEOF <- struct{}{}
+						}
+						break
+					}
+				}
+
+				if trailingMessage != "" {
+					conn.Write([]byte(trailingMessage))
+				}
+			}(conn)
+		}
+	}()
+
+	return listener
+}
+
+// TestConnectClientDisconnect verifies that when the client abruptly closes
+// its side of a CONNECT tunnel, proxii's tunnel.Pump notices promptly (the
+// client's EOF is passed on to the origin as a half-close) instead of
+// leaking the server-side connection until it times out on its own.
+func TestConnectClientDisconnect(t *testing.T) {
+	recvEOF := make(chan struct{}, 1)
+	origin := newEchoTCPServer(t, "", recvEOF)
+	defer origin.Close()
+
+	proxii, err := newProxii("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot start proxii:", err)
+	}
+	defer proxii.close()
+
+	go proxii.serve()
+
+	clientConn := connectThroughProxii(t, proxii.listener.Addr().String(), origin.Addr().String())
+
+	fmt.Fprint(clientConn, "ping")
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(clientConn, buf); err != nil {
+		t.Fatal("Did not receive echo:", err)
+	}
+
+	clientConn.Close()
+
+	select {
+	case <-recvEOF:
+	case <-time.After(2 * time.Second):
+		t.Error("Origin did not observe EOF after client disconnect")
+	}
+}
+
+// TestConnectClientShutdownWrite verifies that when the client shuts down
+// its write side (half-close) but keeps reading, proxii propagates the
+// half-close to the origin (so the origin sees EOF) while still relaying
+// whatever the origin writes back afterwards.
+func TestConnectClientShutdownWrite(t *testing.T) {
+	trailing := "bye"
+	origin := newEchoTCPServer(t, trailing, nil)
+	defer origin.Close()
+
+	proxii, err := newProxii("127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot start proxii:", err)
+	}
+	defer proxii.close()
+
+	go proxii.serve()
+
+	clientConn := connectThroughProxii(t, proxii.listener.Addr().String(), origin.Addr().String())
+	defer clientConn.Close()
+
+	fmt.Fprint(clientConn, "ping")
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(clientConn, buf); err != nil {
+		t.Fatal("Did not receive echo:", err)
+	}
+
+	tcpConn, ok := clientConn.(*net.TCPConn)
+	if !ok {
+		t.Fatal("Expected a *net.TCPConn")
+	}
+
+	if err := tcpConn.CloseWrite(); err != nil {
+		t.Fatal("CloseWrite failed:", err)
+	}
+
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	trailingBuf := make([]byte, len(trailing))
+	if _, err := io.ReadFull(clientConn, trailingBuf); err != nil {
+		t.Fatal("Did not receive trailing message after shutdown-write:", err)
+	}
+
+	if string(trailingBuf) != trailing {
+		t.Errorf("Trailing message %q != expected %q", string(trailingBuf), trailing)
+	}
+}
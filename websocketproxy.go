@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const wsControlWriteTimeout = time.Second
+
+// WebSocketMessageHook is invoked for every WebSocket data (text or binary)
+// message proxied in either direction, before it is forwarded; ping, pong
+// and close control frames are not reported. direction is "up" (client to
+// origin) or "down" (origin to client).
+type WebSocketMessageHook func(record *Record, direction string, messageType int, data []byte)
+
+// SetWebSocketMessageHook registers the hook invoked for every proxied
+// WebSocket message. Passing nil disables per-message inspection.
+func (p *proxii) SetWebSocketMessageHook(hook WebSocketMessageHook) {
+	p.wsMessageHook = hook
+}
+
+// wsForwardableHeaders are the request headers copied onto the dial to the
+// origin. The handshake fields (Upgrade, Connection, Sec-WebSocket-*) are
+// deliberately excluded: the Dialer sets those itself, and the subprotocol
+// list is forwarded separately via Dialer.Subprotocols.
+func wsForwardableHeaders(request *http.Request) http.Header {
+	forwarded := make(http.Header)
+
+	for key, values := range request.Header {
+		switch http.CanonicalHeaderKey(key) {
+		case "Connection", "Upgrade",
+			"Sec-Websocket-Key", "Sec-Websocket-Version",
+			"Sec-Websocket-Extensions", "Sec-Websocket-Protocol",
+			"Proxy-Connection":
+			continue
+		}
+
+		forwarded[key] = values
+	}
+
+	return forwarded
+}
+
+// dialWebsocketOrigin connects to the WebSocket origin behind request,
+// forwarding the client's offered subprotocols and permessage-deflate
+// preference.
+func dialWebsocketOrigin(ctx context.Context, dial dialFunc, request *http.Request) (*websocket.Conn, *http.Response, error) {
+	offersDeflate := strings.Contains(
+		strings.ToLower(strings.Join(request.Header.Values("Sec-Websocket-Extensions"), ",")),
+		"permessage-deflate")
+
+	dialer := &websocket.Dialer{
+		NetDialContext:    dial,
+		EnableCompression: offersDeflate,
+		HandshakeTimeout:  10 * time.Second,
+		Subprotocols:      websocket.Subprotocols(request),
+	}
+
+	originURL := *request.URL
+	originURL.Scheme = "ws"
+	if request.TLS != nil {
+		originURL.Scheme = "wss"
+	}
+	originURL.Host = request.Host
+
+	return dialer.DialContext(ctx, originURL.String(), wsForwardableHeaders(request))
+}
+
+// pumpWebsocket shuttles WebSocket messages between client and origin in
+// both directions, forwarding ping/pong control frames and the close code
+// instead of each side's gorilla connection answering them locally, and
+// reporting every data message to hook (if any) before it is forwarded. It blocks
+// until both directions finish or ctx is canceled, and returns the bytes
+// forwarded in each direction.
+func pumpWebsocket(ctx context.Context, record *Record, client, origin *websocket.Conn, hook WebSocketMessageHook) (clientToOrigin, originToClient int64) {
+	client.SetPingHandler(func(appData string) error {
+		return origin.WriteControl(websocket.PingMessage, []byte(appData), time.Now().Add(wsControlWriteTimeout))
+	})
+	client.SetPongHandler(func(appData string) error {
+		return origin.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(wsControlWriteTimeout))
+	})
+
+	origin.SetPingHandler(func(appData string) error {
+		return client.WriteControl(websocket.PingMessage, []byte(appData), time.Now().Add(wsControlWriteTimeout))
+	})
+	origin.SetPongHandler(func(appData string) error {
+		return client.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(wsControlWriteTimeout))
+	})
+
+	done := make(chan struct{}, 2)
+
+	forward := func(from, to *websocket.Conn, direction string, counter *int64) {
+		defer func() { done <- struct{}{} }()
+
+		for {
+			messageType, data, err := from.ReadMessage()
+			if err != nil {
+				closeCode, closeText := websocket.CloseNormalClosure, ""
+				if ce, ok := err.(*websocket.CloseError); ok {
+					closeCode, closeText = ce.Code, ce.Text
+				}
+
+				to.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, closeText), time.Now().Add(wsControlWriteTimeout))
+
+				return
+			}
+
+			*counter += int64(len(data))
+
+			if hook != nil {
+				hook(record, direction, messageType, data)
+			}
+
+			if err := to.WriteMessage(messageType, data); err != nil {
+				return
+			}
+		}
+	}
+
+	go forward(client, origin, "up", &clientToOrigin)
+	go forward(origin, client, "down", &originToClient)
+
+	// Whichever happens first - ctx canceled, or one direction finishing
+	// (peer gone, clean close, read/write error) - close both conns so the
+	// other forward goroutine's blocked ReadMessage unblocks with an error
+	// instead of waiting forever on a peer that will never send again.
+	select {
+	case <-ctx.Done():
+	case <-done:
+	}
+
+	client.Close()
+	origin.Close()
+
+	<-done
+
+	return clientToOrigin, originToClient
+}
+
+// negotiatedSubprotocolHeader returns the response header set needed to
+// tell the client which subprotocol the origin picked, if any, so the
+// client-facing Upgrader answers with the same value instead of
+// renegotiating independently.
+func negotiatedSubprotocolHeader(originHandshake *http.Response) http.Header {
+	header := make(http.Header)
+
+	if proto := originHandshake.Header.Get("Sec-WebSocket-Protocol"); proto != "" {
+		header.Set("Sec-WebSocket-Protocol", proto)
+	}
+
+	return header
+}
+
+func isWebsocketUpgrade(request *http.Request) bool {
+	return strings.EqualFold(request.Header.Get("Connection"), "upgrade") &&
+		strings.EqualFold(request.Header.Get("Upgrade"), "websocket")
+}